@@ -0,0 +1,115 @@
+package airbyte
+
+import (
+	"github.com/jitsucom/jitsu/server/logging"
+	"io"
+	"sync"
+)
+
+//subscriberBufferedChunks bounds how many pending chunks a single slow subscriber can queue before
+//broadcaster.Write starts dropping data for it, rather than blocking every subscriber (and the
+//underlying stdcopy demux) on the slowest one
+const subscriberBufferedChunks = 256
+
+//broadcaster fans a single stream out to any number of concurrently attached io.Writers.
+//Writers can be attached and detached while data is flowing; a slow or blocked subscriber
+//never backs up the others, or the broadcaster's own Write, since delivery to it is buffered
+//and non-blocking: once its buffer is full, further chunks for that subscriber are dropped.
+type broadcaster struct {
+	mu          sync.Mutex
+	subscribers map[int]*subscriber
+	nextID      int
+	closed      bool
+}
+
+type subscriber struct {
+	chunks chan []byte
+	done   chan struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subscribers: map[int]*subscriber{}}
+}
+
+//attach registers w as a subscriber and returns a detach func that stops forwarding to it.
+//Safe to call after the broadcaster has started (or even finished) writing.
+func (b *broadcaster) attach(w io.Writer) (detach func()) {
+	sub := &subscriber{chunks: make(chan []byte, subscriberBufferedChunks), done: make(chan struct{})}
+
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	if b.closed {
+		b.mu.Unlock()
+		return func() {}
+	}
+	b.subscribers[id] = sub
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case chunk, ok := <-sub.chunks:
+				if !ok {
+					return
+				}
+				w.Write(chunk)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		b.mu.Lock()
+		_, attached := b.subscribers[id]
+		delete(b.subscribers, id)
+		b.mu.Unlock()
+		//Close already stopped this subscriber if it is no longer in the map
+		if attached {
+			close(sub.done)
+		}
+	}
+}
+
+//Write implements io.Writer, fanning a copy of p out to every currently attached subscriber.
+//Delivery is non-blocking: a subscriber whose buffer is full has this chunk dropped for it instead
+//of stalling the write, since p's underlying stdcopy demux must keep draining the container's stdout/stderr.
+func (b *broadcaster) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	subs := make([]*subscriber, 0, len(b.subscribers))
+	for _, s := range b.subscribers {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+
+	if len(subs) == 0 {
+		return len(p), nil
+	}
+
+	chunk := append([]byte(nil), p...)
+	for _, s := range subs {
+		select {
+		case s.chunks <- chunk:
+		default:
+			logging.Warnf("airbyte broadcaster: subscriber buffer full, dropping %d bytes", len(chunk))
+		}
+	}
+
+	return len(p), nil
+}
+
+//Close detaches and stops every subscriber; further attach calls become no-ops
+func (b *broadcaster) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	subs := b.subscribers
+	b.subscribers = map[int]*subscriber{}
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		close(s.done)
+	}
+
+	return nil
+}
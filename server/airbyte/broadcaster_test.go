@@ -0,0 +1,124 @@
+package airbyte
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBroadcasterFanOut(t *testing.T) {
+	b := newBroadcaster()
+
+	var buf1, buf2 safeBuffer
+	detach1 := b.attach(&buf1)
+	detach2 := b.attach(&buf2)
+	defer detach1()
+	defer detach2()
+
+	b.Write([]byte("hello"))
+
+	waitFor(t, func() bool { return buf1.String() == "hello" })
+	waitFor(t, func() bool { return buf2.String() == "hello" })
+}
+
+func TestBroadcasterDetachStopsForwarding(t *testing.T) {
+	b := newBroadcaster()
+
+	var buf safeBuffer
+	detach := b.attach(&buf)
+
+	b.Write([]byte("before"))
+	waitFor(t, func() bool { return buf.String() == "before" })
+
+	detach()
+	b.Write([]byte("after"))
+
+	time.Sleep(20 * time.Millisecond)
+	if got := buf.String(); got != "before" {
+		t.Fatalf("expected detach to stop forwarding, got %q", got)
+	}
+}
+
+func TestBroadcasterCloseStopsFutureAttach(t *testing.T) {
+	b := newBroadcaster()
+	b.Close()
+
+	var buf safeBuffer
+	detach := b.attach(&buf)
+	defer detach()
+
+	b.Write([]byte("ignored"))
+
+	time.Sleep(20 * time.Millisecond)
+	if got := buf.String(); got != "" {
+		t.Fatalf("expected attach after Close to be a no-op, got %q", got)
+	}
+}
+
+func TestBroadcasterWriteNeverBlocksOnAStalledSubscriber(t *testing.T) {
+	b := newBroadcaster()
+
+	block := make(chan struct{})
+	defer close(block)
+	detach := b.attach(blockingWriter{block})
+	defer detach()
+
+	var fast safeBuffer
+	detachFast := b.attach(&fast)
+	defer detachFast()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < subscriberBufferedChunks*2; i++ {
+			b.Write([]byte("x"))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcaster.Write blocked on a stalled subscriber")
+	}
+
+	waitFor(t, func() bool { return fast.String() != "" })
+}
+
+type blockingWriter struct {
+	block chan struct{}
+}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.block
+	return len(p), nil
+}
+
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("condition not met before deadline")
+}
@@ -0,0 +1,62 @@
+package airbyte
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jitsucom/jitsu/server/drivers/base"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+//StateCheckpointer persists the latest STATE message emitted by a running source so a killed or
+//timed-out Read can resume from it instead of re-reading from scratch
+type StateCheckpointer interface {
+	Persist(streamName string, state json.RawMessage) error
+}
+
+//fileStateCheckpointer atomically writes the latest state to Instance.WorkspaceVolume/sourceID/dockerImage/state.json
+//(the file the container sees as VolumeAlias/sourceID/dockerImage/state.json),
+//writing to a .tmp file first and renaming over the target so a crash never leaves a half-written checkpoint
+type fileStateCheckpointer struct {
+	mu       sync.Mutex
+	filePath string
+}
+
+func newFileStateCheckpointer(sourceID, dockerImage string) *fileStateCheckpointer {
+	return &fileStateCheckpointer{filePath: stateCheckpointPath(sourceID, dockerImage)}
+}
+
+//Persist overwrites the checkpoint file with state. streamName only labels error messages (ReadCtx passes
+//the source ID); the checkpoint file holds the latest whole-source state, the same shape --state already expects.
+func (c *fileStateCheckpointer) Persist(streamName string, state json.RawMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmpPath := c.filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, state, 0644); err != nil {
+		return fmt.Errorf("error writing state checkpoint [%s] for stream [%s]: %v", tmpPath, streamName, err)
+	}
+
+	if err := os.Rename(tmpPath, c.filePath); err != nil {
+		return fmt.Errorf("error committing state checkpoint [%s] for stream [%s]: %v", c.filePath, streamName, err)
+	}
+
+	return nil
+}
+
+//stateCheckpointPath returns where Persist writes and where Read looks for a resumable checkpoint
+func stateCheckpointPath(sourceID, dockerImage string) string {
+	return path.Join(Instance.WorkspaceVolume, sourceID, dockerImage, base.StateFileName)
+}
+
+//existingCheckpoint returns the in-container path (under VolumeAlias) of a previously persisted checkpoint for
+//sourceID/dockerImage, or "" if none exists yet
+func existingCheckpoint(sourceID, dockerImage string) string {
+	if _, err := os.Stat(stateCheckpointPath(sourceID, dockerImage)); err != nil {
+		return ""
+	}
+
+	return path.Join(VolumeAlias, sourceID, dockerImage, base.StateFileName)
+}
@@ -0,0 +1,81 @@
+package airbyte
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileStateCheckpointerPersistIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "state.json")
+	checkpointer := &fileStateCheckpointer{filePath: filePath}
+
+	state := json.RawMessage(`{"cursor":1}`)
+	if err := checkpointer.Persist("my_stream", state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filePath + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected the .tmp file to be renamed away, got err=%v", err)
+	}
+
+	got, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("error reading persisted checkpoint: %v", err)
+	}
+	if string(got) != string(state) {
+		t.Fatalf("expected %s, got %s", state, got)
+	}
+}
+
+func TestFileStateCheckpointerPersistOverwritesPreviousState(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "state.json")
+	checkpointer := &fileStateCheckpointer{filePath: filePath}
+
+	if err := checkpointer.Persist("s", json.RawMessage(`{"cursor":1}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkpointer.Persist("s", json.RawMessage(`{"cursor":2}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("error reading persisted checkpoint: %v", err)
+	}
+	if string(got) != `{"cursor":2}` {
+		t.Fatalf("expected the latest state to win, got %s", got)
+	}
+}
+
+func TestWatchStateExtractsStateAndPassesBytesThrough(t *testing.T) {
+	var seen []json.RawMessage
+
+	input := "{\"type\":\"LOG\",\"log\":{\"message\":\"hi\"}}\n" +
+		"{\"type\":\"STATE\",\"state\":{\"cursor\":1}}\n" +
+		"{\"type\":\"RECORD\",\"record\":{}}\n"
+
+	r := watchState(strings.NewReader(input), func(state json.RawMessage) {
+		seen = append(seen, state)
+	})
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != input {
+		t.Fatalf("expected watchState to pass bytes through unchanged, got %q", out)
+	}
+
+	if len(seen) != 1 {
+		t.Fatalf("expected exactly one STATE message to be observed, got %d", len(seen))
+	}
+	if string(seen[0]) != `{"cursor":1}` {
+		t.Fatalf("expected the state payload to be extracted, got %s", seen[0])
+	}
+}
@@ -0,0 +1,160 @@
+package airbyte
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jitsucom/jitsu/server/logging"
+	"github.com/jitsucom/jitsu/server/runner"
+	"io"
+	"time"
+)
+
+//HealthStatus mirrors the states docker/podman healthchecks surface for a container
+type HealthStatus string
+
+const (
+	HealthStarting  HealthStatus = "starting"
+	HealthHealthy   HealthStatus = "healthy"
+	HealthUnhealthy HealthStatus = "unhealthy"
+)
+
+const (
+	defaultHealthPollInterval = 2 * time.Second
+	defaultHealthTimeout      = time.Minute
+)
+
+//errContainerExited is returned by the unexported exit-aware wait when the container stops before ever
+//being observed healthy. It's never returned by the public WaitHealthy, which has no exit signal to race
+//against; run() uses it to tell "gave up waiting" apart from "the container already finished, go report
+//its real exit status" so it doesn't block out the rest of the health-check timeout for nothing.
+var errContainerExited = errors.New("airbyte container exited before becoming healthy")
+
+//HealthCheckOptions configures WaitHealthy
+type HealthCheckOptions struct {
+	//PollInterval is how often docker's health status is re-inspected. Defaults to 2s. The first-message
+	//probe waits on stdout instead of polling and does not use it.
+	PollInterval time.Duration
+	//Timeout bounds the whole wait. Defaults to 1m.
+	Timeout time.Duration
+}
+
+func (o HealthCheckOptions) withDefaults() HealthCheckOptions {
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultHealthPollInterval
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultHealthTimeout
+	}
+	return o
+}
+
+//WaitHealthy blocks until the running container is observed healthy, ctx is done, or opts.Timeout elapses.
+//When the image declares a HEALTHCHECK, docker's own container health status is polled. Otherwise it falls
+//back to a first-message probe: the source is considered healthy as soon as it emits its first Airbyte
+//protocol message (LOG/SPEC/...) on stdout, since that's the earliest observable sign the SDK finished
+//initializing. A timed-out wait returns runner.ErrNotReady so callers retry instead of failing the sync outright.
+func (r *Runner) WaitHealthy(ctx context.Context, opts HealthCheckOptions) (HealthStatus, error) {
+	return r.waitHealthy(ctx, opts, nil)
+}
+
+//waitHealthy is WaitHealthy plus an optional exited signal: when exited fires before the container is seen
+//healthy, it returns errContainerExited immediately instead of blocking until opts.Timeout, so a container
+//that dies on startup doesn't stall the whole call behind a health probe that will never succeed. run() is
+//the only caller with an exited channel to pass; WaitHealthy passes nil, which blocks forever and so never
+//changes behavior for external callers.
+func (r *Runner) waitHealthy(ctx context.Context, opts HealthCheckOptions, exited <-chan struct{}) (HealthStatus, error) {
+	opts = opts.withDefaults()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	if r.containerID == "" {
+		return HealthStarting, fmt.Errorf("airbyte container [%s] is not created yet", r.identifier)
+	}
+
+	cli, err := getDockerClient()
+	if err != nil {
+		return HealthStarting, err
+	}
+
+	inspect, err := cli.ContainerInspect(ctx, r.containerID)
+	if err == nil && inspect.State != nil && inspect.State.Health != nil {
+		return r.waitDockerHealth(ctx, opts, exited)
+	}
+
+	return r.waitFirstMessage(ctx, opts, exited)
+}
+
+//waitDockerHealth polls ContainerInspect().State.Health.Status until it settles on healthy/unhealthy
+func (r *Runner) waitDockerHealth(ctx context.Context, opts HealthCheckOptions, exited <-chan struct{}) (HealthStatus, error) {
+	cli, err := getDockerClient()
+	if err != nil {
+		return HealthStarting, err
+	}
+
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		inspect, err := cli.ContainerInspect(ctx, r.containerID)
+		if err == nil && inspect.State != nil && inspect.State.Health != nil {
+			switch HealthStatus(inspect.State.Health.Status) {
+			case HealthHealthy:
+				return HealthHealthy, nil
+			case HealthUnhealthy:
+				return HealthUnhealthy, fmt.Errorf("airbyte container [%s] reported unhealthy", r.identifier)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			logging.Warnf("[%s] timed out waiting for a healthy container: %v", r.identifier, ctx.Err())
+			return HealthStarting, runner.ErrNotReady
+		case <-exited:
+			return HealthStarting, errContainerExited
+		case <-ticker.C:
+		}
+	}
+}
+
+//waitFirstMessage attaches to the container's stdout broadcaster and waits for the first non-empty line,
+//treating it as evidence the Airbyte source has finished starting up and begun emitting protocol messages.
+//It gives up with runner.ErrNotReady once opts.Timeout elapses; opts.PollInterval is not used.
+//Whichever way the wait ends, pr is closed here too: detach only stops the broadcaster from writing into
+//pw, it doesn't unblock a scanner already parked in a read on pr, so without this the goroutine below would
+//sit there forever every time the wait isn't settled by the first line arriving.
+func (r *Runner) waitFirstMessage(ctx context.Context, opts HealthCheckOptions, exited <-chan struct{}) (HealthStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.withDefaults().Timeout)
+	defer cancel()
+
+	firstLine := make(chan struct{}, 1)
+	pr, pw := io.Pipe()
+	detach := r.AttachStdout(pw)
+
+	go func() {
+		defer detach()
+		defer pw.Close()
+		scanner := bufio.NewScanner(pr)
+		if scanner.Scan() {
+			select {
+			case firstLine <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	select {
+	case <-firstLine:
+		pr.Close()
+		return HealthHealthy, nil
+	case <-ctx.Done():
+		logging.Warnf("[%s] timed out waiting for the first airbyte message: %v", r.identifier, ctx.Err())
+		pr.CloseWithError(ctx.Err())
+		return HealthStarting, runner.ErrNotReady
+	case <-exited:
+		pr.CloseWithError(errContainerExited)
+		return HealthStarting, errContainerExited
+	}
+}
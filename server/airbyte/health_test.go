@@ -0,0 +1,127 @@
+package airbyte
+
+import (
+	"context"
+	"github.com/jitsucom/jitsu/server/runner"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckOptionsWithDefaults(t *testing.T) {
+	opts := HealthCheckOptions{}.withDefaults()
+	if opts.PollInterval != defaultHealthPollInterval {
+		t.Fatalf("expected default poll interval, got %v", opts.PollInterval)
+	}
+	if opts.Timeout != defaultHealthTimeout {
+		t.Fatalf("expected default timeout, got %v", opts.Timeout)
+	}
+
+	custom := HealthCheckOptions{PollInterval: time.Second, Timeout: 5 * time.Second}.withDefaults()
+	if custom.PollInterval != time.Second || custom.Timeout != 5*time.Second {
+		t.Fatalf("expected explicit options to be preserved, got %+v", custom)
+	}
+}
+
+func TestWaitFirstMessageReturnsHealthyOnFirstLine(t *testing.T) {
+	r := NewRunner("test-source", "0.1.0", "test-container")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		status, err := r.waitFirstMessage(context.Background(), HealthCheckOptions{PollInterval: time.Millisecond, Timeout: time.Second}, nil)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if status != HealthHealthy {
+			t.Errorf("expected HealthHealthy, got %v", status)
+		}
+	}()
+
+	//waitFirstMessage attaches its subscriber at the start of the call; keep nudging stdout until it's
+	//observed so the test doesn't race the attach
+	go func() {
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				r.stdoutBroadcaster.Write([]byte(`{"type":"LOG","log":{"message":"starting"}}` + "\n"))
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waitFirstMessage did not return in time")
+	}
+}
+
+func TestWaitFirstMessageTimesOut(t *testing.T) {
+	r := NewRunner("test-source", "0.1.0", "test-container")
+
+	status, err := r.waitFirstMessage(context.Background(), HealthCheckOptions{PollInterval: time.Millisecond, Timeout: 20 * time.Millisecond}, nil)
+	if err != runner.ErrNotReady {
+		t.Fatalf("expected runner.ErrNotReady, got %v", err)
+	}
+	if status != HealthStarting {
+		t.Fatalf("expected HealthStarting, got %v", status)
+	}
+}
+
+func TestWaitFirstMessageDoesNotLeakScannerGoroutineOnTimeout(t *testing.T) {
+	r := NewRunner("test-source", "0.1.0", "test-container")
+
+	before := runtime.NumGoroutine()
+
+	if _, err := r.waitFirstMessage(context.Background(), HealthCheckOptions{PollInterval: time.Millisecond, Timeout: 20 * time.Millisecond}, nil); err != runner.ErrNotReady {
+		t.Fatalf("expected runner.ErrNotReady, got %v", err)
+	}
+
+	//the scanner goroutine is parked in a blocking read on pr until waitFirstMessage closes it on the way
+	//out; if that close is missing, NumGoroutine never comes back down to its pre-call baseline
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+}
+
+func TestWaitFirstMessageReturnsOnContainerExit(t *testing.T) {
+	r := NewRunner("test-source", "0.1.0", "test-container")
+
+	exited := make(chan struct{})
+	close(exited)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		status, err := r.waitFirstMessage(context.Background(), HealthCheckOptions{PollInterval: time.Millisecond, Timeout: time.Minute}, exited)
+		if err != errContainerExited {
+			t.Errorf("expected errContainerExited, got %v", err)
+		}
+		if status != HealthStarting {
+			t.Errorf("expected HealthStarting, got %v", status)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitFirstMessage did not return promptly once the container exited")
+	}
+}
+
+func TestWaitDockerHealthReturnsOnContainerExit(t *testing.T) {
+	r := NewRunner("test-source", "0.1.0", "test-container")
+
+	exited := make(chan struct{})
+	close(exited)
+
+	status, err := r.waitDockerHealth(context.Background(), HealthCheckOptions{PollInterval: time.Millisecond, Timeout: time.Minute}, exited)
+	if err != errContainerExited {
+		t.Fatalf("expected errContainerExited, got %v", err)
+	}
+	if status != HealthStarting {
+		t.Fatalf("expected HealthStarting, got %v", status)
+	}
+}
@@ -1,8 +1,15 @@
 package airbyte
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/jitsucom/jitsu/server/drivers/base"
 	"github.com/jitsucom/jitsu/server/logging"
 	"github.com/jitsucom/jitsu/server/parsers"
@@ -11,10 +18,8 @@ import (
 	"github.com/jitsucom/jitsu/server/uuid"
 	"io"
 	"os"
-	"os/exec"
 	"path"
 	"runtime/debug"
-	"strings"
 	"sync"
 	"time"
 )
@@ -22,8 +27,26 @@ import (
 const (
 	connectionStatusSucceed = "SUCCEEDED"
 	connectionStatusFailed  = "FAILED"
+
+	containerStopTimeout = 10 * time.Second
+)
+
+//dockerClient is a lazily initialized Docker Engine API client shared by every Runner.
+//It talks to the daemon over the UNIX socket (or DOCKER_HOST, if set) so Jitsu no longer
+//depends on a docker CLI binary being present on the host.
+var (
+	dockerClient     *client.Client
+	dockerClientErr  error
+	dockerClientOnce sync.Once
 )
 
+func getDockerClient() (*client.Client, error) {
+	dockerClientOnce.Do(func() {
+		dockerClient, dockerClientErr = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	})
+	return dockerClient, dockerClientErr
+}
+
 //Runner is an Airbyte Docker runner
 //Can only be used once
 //Self-closed (see run() func)
@@ -35,7 +58,15 @@ type Runner struct {
 	identifier string
 	closed     chan struct{}
 
-	command *exec.Cmd
+	containerID string
+
+	//stdoutBroadcaster/stderrBroadcaster fan the running container's streams out to
+	//subscribers attached via AttachStdout/AttachStderr, in addition to the normal parser pipeline
+	stdoutBroadcaster *broadcaster
+	stderrBroadcaster *broadcaster
+
+	lastStateMu sync.Mutex
+	lastState   json.RawMessage
 }
 
 //NewRunner returns configured Airbyte Runner
@@ -44,28 +75,58 @@ func NewRunner(dockerImage, imageVersion, identifier string) *Runner {
 		identifier = fmt.Sprintf("%s-%s-%s", dockerImage, imageVersion, uuid.New())
 	}
 	return &Runner{
-		DockerImage: dockerImage,
-		Version:     imageVersion,
-		identifier:  identifier,
-		closed:      make(chan struct{}),
+		DockerImage:       dockerImage,
+		Version:           imageVersion,
+		identifier:        identifier,
+		closed:            make(chan struct{}),
+		stdoutBroadcaster: newBroadcaster(),
+		stderrBroadcaster: newBroadcaster(),
 	}
 }
 
-//String returns exec command string
-func (r *Runner) String() string {
-	if r.command == nil {
-		return ""
-	}
+//AttachStdout subscribes w to the container's demuxed stdout stream for as long as it stays attached.
+//Can be called before or after the container has started. Returns a detach func to unsubscribe.
+func (r *Runner) AttachStdout(w io.Writer) (detach func()) {
+	return r.stdoutBroadcaster.attach(w)
+}
 
-	return r.command.String()
+//AttachStderr subscribes w to the container's demuxed stderr stream for as long as it stays attached.
+//Can be called before or after the container has started. Returns a detach func to unsubscribe.
+func (r *Runner) AttachStderr(w io.Writer) (detach func()) {
+	return r.stderrBroadcaster.attach(w)
+}
+
+//setLastState records the most recent STATE message seen during Read, regardless of how the run ends
+func (r *Runner) setLastState(state json.RawMessage) {
+	r.lastStateMu.Lock()
+	defer r.lastStateMu.Unlock()
+	r.lastState = state
+}
+
+//LastState returns the most recent STATE message observed during Read, or nil if none was emitted yet.
+//The task closer can call this even after a forced Close() to persist progress that would otherwise be lost.
+func (r *Runner) LastState() json.RawMessage {
+	r.lastStateMu.Lock()
+	defer r.lastStateMu.Unlock()
+	return r.lastState
+}
+
+//String returns the image reference and container name this Runner drives
+func (r *Runner) String() string {
+	return fmt.Sprintf("%s:%s [%s]", r.DockerImage, r.Version, r.identifier)
 }
 
 //Spec runs airbyte docker spec command and returns spec and err if occurred
 func (r *Runner) Spec() (interface{}, error) {
+	return r.SpecCtx(context.Background())
+}
+
+//SpecCtx is Spec with an externally cancellable context: cancelling ctx stops the container early
+func (r *Runner) SpecCtx(ctx context.Context) (interface{}, error) {
 	resultParser := &synchronousParser{desiredRowType: SpecType}
 	errWriter := logging.NewStringWriter()
 
-	err := r.run(resultParser.parse, copyTo(errWriter), time.Minute, "run", "--rm", "-i", "--name", r.identifier, fmt.Sprintf("%s:%s", Instance.AddAirbytePrefix(r.DockerImage), r.Version), "spec")
+	err := r.run(ctx, resultParser.parse, copyTo(errWriter), time.Minute, nil, "spec")
 	if err != nil {
 		if err == runner.ErrNotReady {
 			return nil, err
@@ -80,6 +141,11 @@ func (r *Runner) Spec() (interface{}, error) {
 }
 
 func (r *Runner) Check(airbyteSourceConfig interface{}) error {
+	return r.CheckCtx(context.Background(), airbyteSourceConfig)
+}
+
+//CheckCtx is Check with an externally cancellable context: cancelling ctx stops the container early
+func (r *Runner) CheckCtx(ctx context.Context, airbyteSourceConfig interface{}) error {
 	resultParser := &synchronousParser{desiredRowType: ConnectionStatusType}
 	errWriter := logging.NewStringWriter()
 
@@ -93,8 +159,8 @@ func (r *Runner) Check(airbyteSourceConfig interface{}) error {
 		}
 	}()
 
-	err = r.run(resultParser.parse, copyTo(errWriter), time.Minute,
-		"run", "--rm", "-i", "--name", r.identifier, "-v", fmt.Sprintf("%s:%s", Instance.WorkspaceVolume, VolumeAlias), fmt.Sprintf("%s:%s", Instance.AddAirbytePrefix(r.DockerImage), r.Version), "check", "--config", path.Join(VolumeAlias, relatedFilePath))
+	err = r.run(ctx, resultParser.parse, copyTo(errWriter), time.Minute, workspaceMounts(),
+		"check", "--config", path.Join(VolumeAlias, relatedFilePath))
 	if err != nil {
 		if err == runner.ErrNotReady {
 			return err
@@ -117,6 +183,11 @@ func (r *Runner) Check(airbyteSourceConfig interface{}) error {
 
 //Discover returns discovered raw catalog
 func (r *Runner) Discover(airbyteSourceConfig interface{}, timeout time.Duration) (*CatalogRow, error) {
+	return r.DiscoverCtx(context.Background(), airbyteSourceConfig, timeout)
+}
+
+//DiscoverCtx is Discover with an externally cancellable context: cancelling ctx stops the container early
+func (r *Runner) DiscoverCtx(ctx context.Context, airbyteSourceConfig interface{}, timeout time.Duration) (*CatalogRow, error) {
 	resultParser := &synchronousParser{desiredRowType: CatalogType}
 	errStrWriter := logging.NewStringWriter()
 	dualStdErrWriter := logging.Dual{FileWriter: errStrWriter, Stdout: logging.NewPrefixDateTimeProxy("[discover]", Instance.LogWriter)}
@@ -131,8 +202,8 @@ func (r *Runner) Discover(airbyteSourceConfig interface{}, timeout time.Duration
 		}
 	}()
 
-	err = r.run(resultParser.parse, copyTo(dualStdErrWriter), timeout,
-		"run", "--rm", "-i", "--name", r.identifier, "-v", fmt.Sprintf("%s:%s", Instance.WorkspaceVolume, VolumeAlias), fmt.Sprintf("%s:%s", Instance.AddAirbytePrefix(r.DockerImage), r.Version), "discover", "--config", path.Join(VolumeAlias, relatedFilePath))
+	err = r.run(ctx, resultParser.parse, copyTo(dualStdErrWriter), timeout, workspaceMounts(),
+		"discover", "--config", path.Join(VolumeAlias, relatedFilePath))
 	if err != nil {
 		if err == runner.ErrNotReady {
 			return nil, err
@@ -147,6 +218,21 @@ func (r *Runner) Discover(airbyteSourceConfig interface{}, timeout time.Duration
 }
 
 func (r *Runner) Read(dataConsumer base.CLIDataConsumer, streamsRepresentation map[string]*base.StreamRepresentation, taskLogger logging.TaskLogger, taskCloser base.CLITaskCloser, sourceID, statePath string) error {
+	return r.ReadCtx(context.Background(), dataConsumer, streamsRepresentation, taskLogger, taskCloser, sourceID, statePath)
+}
+
+//ReadCtx is Read with an externally cancellable context, letting CLITaskCloser or an orchestrator-enforced
+//per-source deadline stop the sync cleanly instead of only relying on the fixed 24h timeout
+func (r *Runner) ReadCtx(ctx context.Context, dataConsumer base.CLIDataConsumer, streamsRepresentation map[string]*base.StreamRepresentation, taskLogger logging.TaskLogger, taskCloser base.CLITaskCloser, sourceID, statePath string) error {
+	if statePath == "" {
+		if resumePath := existingCheckpoint(sourceID, r.DockerImage); resumePath != "" {
+			taskLogger.INFO("ID [%s] resuming from checkpoint [%s]", r.identifier, resumePath)
+			statePath = resumePath
+		}
+	}
+
+	checkpointer := newFileStateCheckpointer(sourceID, r.DockerImage)
+
 	asyncParser := &asynchronousParser{
 		dataConsumer:          dataConsumer,
 		streamsRepresentation: streamsRepresentation,
@@ -154,6 +240,16 @@ func (r *Runner) Read(dataConsumer base.CLIDataConsumer, streamsRepresentation m
 	}
 
 	stdoutHandler := func(stdout io.Reader) error {
+		//watchState taps every STATE message flowing to the parser so a kill/timeout can still resume:
+		//it persists the checkpoint to disk and records it for LastState(), without altering what the
+		//parser itself sees
+		stdout = watchState(stdout, func(state json.RawMessage) {
+			if err := checkpointer.Persist(sourceID, state); err != nil {
+				logging.SystemErrorf("[%s] error persisting airbyte state checkpoint: %v", r.identifier, err)
+			}
+			r.setLastState(state)
+		})
+
 		defer func() {
 			if rec := recover(); rec != nil {
 				logging.Error("panic in airbyte runner")
@@ -182,26 +278,52 @@ func (r *Runner) Read(dataConsumer base.CLIDataConsumer, streamsRepresentation m
 
 	dualStdErrWriter := logging.Dual{FileWriter: taskLogger, Stdout: logging.NewPrefixDateTimeProxy(fmt.Sprintf("[%s]", sourceID), Instance.LogWriter)}
 
-	args := []string{"run", "--rm", "-i", "--name", taskCloser.TaskID(), "-v", fmt.Sprintf("%s:%s", Instance.WorkspaceVolume, VolumeAlias), fmt.Sprintf("%s:%s", Instance.AddAirbytePrefix(r.DockerImage), r.Version), "read", "--config", path.Join(VolumeAlias, sourceID, r.DockerImage, base.ConfigFileName), "--catalog", path.Join(VolumeAlias, sourceID, r.DockerImage, base.CatalogFileName)}
+	args := []string{"read", "--config", path.Join(VolumeAlias, sourceID, r.DockerImage, base.ConfigFileName), "--catalog", path.Join(VolumeAlias, sourceID, r.DockerImage, base.CatalogFileName)}
 
 	if statePath != "" {
 		args = append(args, "--state", path.Join(VolumeAlias, sourceID, r.DockerImage, base.StateFileName))
 	}
 
-	taskLogger.INFO("ID [%s] exec: %s %s", r.identifier, DockerCommand, strings.Join(args, " "))
-	return r.run(stdoutHandler, copyTo(dualStdErrWriter), time.Hour*24, args...)
+	r.identifier = taskCloser.TaskID()
+
+	taskLogger.INFO("ID [%s] run: %s %v", r.identifier, Instance.AddAirbytePrefix(r.DockerImage), args)
+	return r.run(ctx, stdoutHandler, copyTo(dualStdErrWriter), time.Hour*24, workspaceMounts(), args...)
 }
 
+//Close stops and removes the underlying container, if one was created
 func (r *Runner) Close() error {
 	if r.terminated() {
 		return runner.ErrAirbyteAlreadyTerminated
 	}
 
 	close(r.closed)
+	r.stdoutBroadcaster.Close()
+	r.stderrBroadcaster.Close()
+
+	if r.containerID == "" {
+		return nil
+	}
+
+	cli, err := getDockerClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), containerStopTimeout+5*time.Second)
+	defer cancel()
+
+	//ContainerStop sends SIGTERM and gives the container containerStopTimeout to exit on its own
+	//before the engine falls back to SIGKILL
+	stopTimeoutSeconds := int(containerStopTimeout.Seconds())
+	if err := cli.ContainerStop(ctx, r.containerID, container.StopOptions{Timeout: &stopTimeoutSeconds}); err != nil {
+		logging.Warnf("[%s] error stopping airbyte container [%s]: %v", r.identifier, r.containerID, err)
+	}
 
-	exec.Command("docker", "stop", r.identifier, "&").Start()
+	if err := cli.ContainerRemove(ctx, r.containerID, types.ContainerRemoveOptions{Force: true}); err != nil {
+		return fmt.Errorf("error removing airbyte container [%s]: %v", r.containerID, err)
+	}
 
-	return r.command.Process.Kill()
+	return nil
 }
 
 func (r *Runner) terminated() bool {
@@ -213,28 +335,64 @@ func (r *Runner) terminated() bool {
 	}
 }
 
-func (r *Runner) run(stdoutHandler, stderrHandler func(io.Reader) error, timeout time.Duration, args ...string) error {
+//workspaceMounts returns the bind mount wiring Jitsu's workspace volume into the container at VolumeAlias
+func workspaceMounts() []mount.Mount {
+	return []mount.Mount{
+		{
+			Type:   mount.TypeBind,
+			Source: Instance.WorkspaceVolume,
+			Target: VolumeAlias,
+		},
+	}
+}
+
+//run pulls the image (if not already present), creates, starts and waits for an Airbyte container
+//running the given command, demuxing its stdout/stderr into stdoutHandler/stderrHandler and returning
+//an error if the container exits with a non-zero status. parentCtx bounds the whole call together with
+//timeout (whichever fires first) and, when cancelled from the outside, triggers a graceful container stop.
+func (r *Runner) run(parentCtx context.Context, stdoutHandler, stderrHandler func(io.Reader) error, timeout time.Duration, mounts []mount.Mount, cmd ...string) error {
 	if r.terminated() {
 		return runner.ErrAirbyteAlreadyTerminated
 	}
 
+	image := fmt.Sprintf("%s:%s", Instance.AddAirbytePrefix(r.DockerImage), r.Version)
+
 	if !Instance.IsImagePulled(Instance.AddAirbytePrefix(r.DockerImage), r.Version) {
 		return runner.ErrNotReady
 	}
 
-	//self closed
+	cli, err := getDockerClient()
+	if err != nil {
+		return fmt.Errorf("error initializing docker client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+
+	resp, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:        image,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, &container.HostConfig{
+		Mounts: mounts,
+	}, nil, nil, r.identifier)
+	if err != nil {
+		return fmt.Errorf("error creating airbyte container [%s]: %v", image, err)
+	}
+	r.containerID = resp.ID
+
+	//self closed: once ctx is done (either the timeout elapsed or the caller cancelled it), Close()
+	//gracefully stops and removes the container
 	safego.Run(func() {
-		ticker := time.NewTicker(timeout)
-		for {
-			select {
-			case <-r.closed:
-				return
-			case <-ticker.C:
-				logging.Warnf("[%s] Airbyte run timeout after [%s]", r.identifier, timeout.String())
-				if err := r.Close(); err != nil {
-					if err != runner.ErrAirbyteAlreadyTerminated {
-						logging.SystemErrorf("Error terminating Airbyte runner [%s:%s] after timeout: %v", r.DockerImage, r.Version, err)
-					}
+		select {
+		case <-r.closed:
+			return
+		case <-ctx.Done():
+			logging.Warnf("[%s] Airbyte run stopped: %v", r.identifier, ctx.Err())
+			if err := r.Close(); err != nil {
+				if err != runner.ErrAirbyteAlreadyTerminated {
+					logging.SystemErrorf("Error terminating Airbyte runner [%s:%s] after %v: %v", r.DockerImage, r.Version, ctx.Err(), err)
 				}
 			}
 		}
@@ -242,41 +400,91 @@ func (r *Runner) run(stdoutHandler, stderrHandler func(io.Reader) error, timeout
 
 	defer r.Close()
 
-	//exec cmd and analyze response from stdout & stderr
-	r.command = exec.Command(DockerCommand, args...)
-	stdout, _ := r.command.StdoutPipe()
-	defer stdout.Close()
-	stderr, _ := r.command.StderrPipe()
-	defer stderr.Close()
-
-	err := r.command.Start()
+	hijacked, err := cli.ContainerAttach(ctx, r.containerID, types.ContainerAttachOptions{Stream: true, Stdout: true, Stderr: true})
 	if err != nil {
-		return err
+		return fmt.Errorf("error attaching to airbyte container [%s]: %v", r.containerID, err)
+	}
+	defer hijacked.Close()
+
+	waitCh, waitErrCh := cli.ContainerWait(ctx, r.containerID, container.WaitConditionNotRunning)
+
+	//waitCh/waitErrCh only ever deliver one value each and must be drained exactly once, but both the
+	//health-check gate below and the exit-code check further down need to know when/how the container
+	//exited. A single goroutine drains them into exit and closes exitedCh, which any number of selects
+	//can then observe without racing each other over the underlying channels.
+	exitedCh := make(chan struct{})
+	var exit containerExit
+	safego.Run(func() {
+		defer close(exitedCh)
+		select {
+		case err := <-waitErrCh:
+			if err != nil {
+				exit.err = fmt.Errorf("error waiting for airbyte container [%s]: %v", r.containerID, err)
+			}
+		case result := <-waitCh:
+			if result.Error != nil {
+				exit.err = fmt.Errorf("airbyte container [%s] wait error: %s", r.containerID, result.Error.Message)
+				return
+			}
+			exit.code = result.StatusCode
+		}
+	})
+
+	if err := cli.ContainerStart(ctx, r.containerID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("error starting airbyte container [%s]: %v", r.containerID, err)
 	}
 
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+
 	var wg sync.WaitGroup
 	var parsingErr error
-	//writing result to stdout
+
 	wg.Add(1)
 	safego.Run(func() {
 		defer wg.Done()
-		parsingErr = stdoutHandler(stdout)
+		parsingErr = stdoutHandler(stdoutReader)
 	})
 
-	//writing process logs to stderr
 	wg.Add(1)
 	safego.Run(func() {
 		defer wg.Done()
-		if readingErr := stderrHandler(stderr); readingErr != nil {
+		if readingErr := stderrHandler(stderrReader); readingErr != nil {
 			logging.SystemErrorf("Error reading airbyte stderr: %v", readingErr)
 		}
 	})
 
+	safego.Run(func() {
+		_, demuxErr := stdcopy.StdCopy(io.MultiWriter(stdoutWriter, r.stdoutBroadcaster), io.MultiWriter(stderrWriter, r.stderrBroadcaster), hijacked.Reader)
+		stdoutWriter.CloseWithError(demuxErr)
+		stderrWriter.CloseWithError(demuxErr)
+		r.stdoutBroadcaster.Close()
+		r.stderrBroadcaster.Close()
+	})
+
+	//Gate on the container actually being ready before trusting its output: Airbyte sources can take tens
+	//of seconds to finish SDK init/oauth refresh/cursor resolution after the process starts. This reuses the
+	//same runner.ErrNotReady sentinel the image-pull precheck above returns, so Spec/Check/Discover's existing
+	//`err == runner.ErrNotReady` branches and Read (which returns run's error as is) hand it to their callers unchanged.
+	//exitedCh is passed through so a container that exits (cleanly or not) before ever becoming healthy is
+	//noticed immediately instead of blocking the gate for the full timeout; errContainerExited just means
+	//"stop waiting, exit below reports what actually happened" and isn't itself surfaced to the caller.
+	if _, err := r.waitHealthy(ctx, HealthCheckOptions{Timeout: timeout}, exitedCh); err != nil && err != errContainerExited {
+		if err == runner.ErrNotReady {
+			return runner.ErrNotReady
+		}
+		return fmt.Errorf("error waiting for airbyte container [%s] to become healthy: %v", r.containerID, err)
+	}
+
 	wg.Wait()
 
-	err = r.command.Wait()
-	if err != nil {
-		return err
+	<-exitedCh
+	if exit.err != nil {
+		return exit.err
+	}
+
+	if exit.code != 0 {
+		return fmt.Errorf("airbyte container [%s] exited with code %d", r.containerID, exit.code)
 	}
 
 	if parsingErr != nil {
@@ -286,6 +494,13 @@ func (r *Runner) run(stdoutHandler, stderrHandler func(io.Reader) error, timeout
 	return nil
 }
 
+//containerExit captures the outcome of cli.ContainerWait, recorded exactly once by run()'s drain
+//goroutine so both the health-check gate and the final exit-code check can read it after exitedCh closes
+type containerExit struct {
+	code int64
+	err  error
+}
+
 func copyTo(writer io.Writer) func(r io.Reader) error {
 	return func(r io.Reader) error {
 		if _, err := io.Copy(writer, r); err != nil {
@@ -315,4 +530,4 @@ func saveConfig(airbyteSourceConfig interface{}) (string, string, error) {
 	}
 
 	return absoluteDirPath, path.Join(dirName, fileName), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,61 @@
+package airbyte
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+const airbyteStateMessageType = "STATE"
+
+//airbyteStateEnvelope is the minimal subset of the Airbyte protocol message needed to recognize a STATE row
+//without depending on the full AirbyteMessage decoding done elsewhere in the parser pipeline
+type airbyteStateEnvelope struct {
+	Type  string          `json:"type"`
+	State json.RawMessage `json:"state"`
+}
+
+//watchState wraps r so that every complete line passing through it is also inspected for an Airbyte STATE
+//message; onState is invoked with the raw state payload whenever one is seen, and the bytes are otherwise
+//passed through completely unchanged so the downstream parser sees exactly what the container emitted
+func watchState(r io.Reader, onState func(state json.RawMessage)) io.Reader {
+	return &stateWatchingReader{src: bufio.NewReaderSize(r, 64*1024), onState: onState}
+}
+
+type stateWatchingReader struct {
+	src     *bufio.Reader
+	onState func(state json.RawMessage)
+	pending []byte
+}
+
+func (s *stateWatchingReader) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		line, err := s.src.ReadBytes('\n')
+		if len(line) > 0 {
+			s.observe(line)
+			s.pending = line
+		}
+		if err != nil && len(line) == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *stateWatchingReader) observe(line []byte) {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 {
+		return
+	}
+
+	var envelope airbyteStateEnvelope
+	if err := json.Unmarshal(trimmed, &envelope); err != nil || envelope.Type != airbyteStateMessageType {
+		return
+	}
+
+	s.onState(envelope.State)
+}